@@ -3,10 +3,16 @@ package main
 import (
 	"github.com/st8ed/aws-cost-exporter/pkg/collector"
 	"github.com/st8ed/aws-cost-exporter/pkg/fetcher"
+	"github.com/st8ed/aws-cost-exporter/pkg/metrics"
 	"github.com/st8ed/aws-cost-exporter/pkg/processor"
 	"github.com/st8ed/aws-cost-exporter/pkg/state"
 
+	"context"
+	"errors"
+	"os/signal"
 	"os/user"
+	"sync"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -14,10 +20,7 @@ import (
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/version"
 
-	"github.com/go-kit/log"
-	"github.com/go-kit/log/level"
-	"github.com/prometheus/common/promlog"
-	"github.com/prometheus/common/promlog/flag"
+	"log/slog"
 
 	"net/http"
 	"os"
@@ -27,75 +30,133 @@ import (
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
-func newGatherer(config *state.Config, state *state.State, disableExporterMetrics bool, logger log.Logger) (prometheus.GathererFunc, error) {
-	level.Info(logger).Log("msg", "newGatherer")
+// newGatherer builds the registry this exporter serves on /metrics. In
+// single-account mode it fetches+ingests one CUR, driven by config's
+// top-level Bucket/Report/ChainedRole. In multi-account mode (config.Accounts
+// non-empty) it fans out over every listed account, assuming each one's role
+// independently so that one payer's assume-role failure doesn't prevent the
+// others' metrics from being served.
+func newGatherer(ctx context.Context, config *state.Config, st *state.State, disableExporterMetrics bool, logger *slog.Logger) (prometheus.GathererFunc, error) {
+	logger.Info("newGatherer")
 	reg := prometheus.NewRegistry()
 
 	if !disableExporterMetrics {
-		level.Info(logger).Log("msg", "export metrics collectors")
+		logger.Info("export metrics collectors")
 		reg.MustRegister(collectors.NewBuildInfoCollector())
 		reg.MustRegister(collectors.NewGoCollector(
 			collectors.WithGoCollections(collectors.GoRuntimeMemStatsCollection | collectors.GoRuntimeMetricsCollection),
 		))
 	}
 
-	level.Info(logger).Log("msg", "billing periods")
-	periods, err := fetcher.GetBillingPeriods(config)
+	m, err := metrics.New(reg)
 	if err != nil {
 		return nil, err
 	}
 
-	state.Periods = periods
+	multiAccount := len(config.Accounts) > 0
 
-	level.Info(logger).Log("msg", "prefetch")
-	if err := collector.Prefetch(state, config, reg, periods, logger); err != nil {
-		return nil, err
+	accounts := config.Accounts
+	if !multiAccount {
+		accounts = []state.Account{{}}
 	}
 
-	if err := state.Save(config); err != nil {
-		return nil, err
+	var assumeRoleErrors *prometheus.CounterVec
+	if multiAccount {
+		assumeRoleErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "aws_cost_exporter_assume_role_errors_total",
+			Help: "Number of times assuming an account's configured role to fetch its CUR failed.",
+		}, []string{"account"})
+		reg.MustRegister(assumeRoleErrors)
 	}
 
-	level.Info(logger).Log("msg", "compute")
-	if err := processor.Compute(config, reg, logger); err != nil {
-		return nil, err
-	}
+	// periodsCache and its mutex are shared across scrapes: promhttp.HandlerFor
+	// doesn't serialize Gather(), so two concurrent scrapes (an HA Prometheus
+	// pair, federation) can both call refreshAll at once and would otherwise
+	// race on this plain map.
+	var periodsCacheMu sync.Mutex
+	periodsCache := make(map[string][]state.BillingPeriod, len(accounts))
+
+	refreshAccount := func(account state.Account, initial bool) error {
+		accountConfig := config
+		if multiAccount {
+			accountConfig = account.Config(config)
+		}
 
-	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
-		if len(state.Periods) > 0 {
-			period := state.Periods[len(state.Periods)-1]
+		periodsCacheMu.Lock()
+		periods, ok := periodsCache[account.Name]
+		periodsCacheMu.Unlock()
+		if !ok {
+			fetched, err := fetcher.GetBillingPeriods(ctx, accountConfig)
+			if err != nil {
+				return err
+			}
+			periods = fetched
+			periodsCacheMu.Lock()
+			periodsCache[account.Name] = periods
+			periodsCacheMu.Unlock()
+		}
+
+		if initial {
+			if err := collector.Prefetch(ctx, st, accountConfig, reg, periods, logger, account.Name, m); err != nil {
+				return err
+			}
+		} else if len(periods) > 0 {
+			period := periods[len(periods)-1]
 
 			if period.IsPastDue() {
-				periods, err := fetcher.GetBillingPeriods(config)
+				fetched, err := fetcher.GetBillingPeriods(ctx, accountConfig)
 				if err != nil {
-					return nil, err
+					return err
 				}
-
-				state.Periods = periods
+				periods = fetched
+				periodsCacheMu.Lock()
+				periodsCache[account.Name] = periods
+				periodsCacheMu.Unlock()
 				period = periods[len(periods)-1]
 			}
 
-			changed, err := collector.UpdateReport(state, config, &period, logger)
+			changed, err := collector.UpdateReport(ctx, st, accountConfig, &period, logger, account.Name, m)
 			if err != nil {
-				level.Error(logger).Log("err", err)
-				return nil, err
+				return err
+			}
+			if !changed {
+				return nil
 			}
+		}
 
-			level.Info(logger).Log("msg", "Reports updated")
-			if changed {
-				level.Info(logger).Log("msg", "Save")
-				if err := state.Save(config); err != nil {
-					level.Error(logger).Log("err", err)
-					return nil, err
-				}
+		if err := st.Save(config); err != nil {
+			return err
+		}
+
+		return processor.Compute(accountConfig, reg, logger, account.Name, m)
+	}
 
-				level.Info(logger).Log("msg", "Compute")
-				if err := processor.Compute(config, reg, logger); err != nil {
-					level.Error(logger).Log("err", err)
-					return nil, err
+	refreshAll := func(initial bool) error {
+		for _, account := range accounts {
+			if err := refreshAccount(account, initial); err != nil {
+				var roleErr *fetcher.AssumeRoleError
+				if multiAccount && errors.As(err, &roleErr) {
+					logger.Error("failed to assume role for account, skipping", "account", account.Name, "err", err)
+					assumeRoleErrors.WithLabelValues(account.Name).Inc()
+					continue
 				}
+				return err
 			}
 		}
+		return nil
+	}
+
+	logger.Info("prefetch")
+	if err := refreshAll(true); err != nil {
+		return nil, err
+	}
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		logger.Info("refresh")
+		if err := refreshAll(false); err != nil {
+			logger.Error("failed to refresh reports", "err", err)
+			return nil, err
+		}
 
 		return reg.Gather()
 	}), nil
@@ -105,13 +166,18 @@ func main() {
 	var (
 		bucketName = kingpin.Flag(
 			"bucket",
-			"Name of the S3 bucket with detailed billing report(s)",
-		).Required().String()
+			"Name of the S3 bucket with detailed billing report(s). Required unless --accounts-config is given.",
+		).Default("").String()
 
 		reportName = kingpin.Flag(
 			"report",
-			"Name of the AWS detailed billing report in supplied S3 bucket",
-		).Required().String()
+			"Name of the AWS detailed billing report in supplied S3 bucket. Required unless --accounts-config is given.",
+		).Default("").String()
+
+		accountsConfigPath = kingpin.Flag(
+			"accounts-config",
+			"Path to a YAML file listing multiple accounts ({name, role_arn, external_id, bucket, report}) to fan out to, instead of the single account configured by --bucket/--report/$AWS_CHAINED_ROLE.",
+		).Default("").String()
 
 		repositoryPath = kingpin.Flag(
 			"repository",
@@ -133,6 +199,36 @@ func main() {
 			"Path to store exporter state",
 		).Default("/var/lib/aws-cost-exporter/state.json").String()
 
+		ingestBatchSize = kingpin.Flag(
+			"ingest.batch-size",
+			"Number of CUR rows committed per sqlite transaction during ingestion",
+		).Default("1000").Int()
+
+		fetchConcurrency = kingpin.Flag(
+			"fetch.concurrency",
+			"Maximum number of billing periods, and of report parts within each billing period, fetched and ingested concurrently",
+		).Default("4").Int()
+
+		s3Endpoint = kingpin.Flag(
+			"s3.endpoint",
+			"Custom S3-compatible endpoint URL (MinIO, Ceph RGW, R2, ...). Leave empty to use AWS S3.",
+		).Default("").String()
+
+		s3Region = kingpin.Flag(
+			"s3.region",
+			"Region to sign S3 requests with when using a custom endpoint",
+		).Default("").String()
+
+		s3ForcePathStyle = kingpin.Flag(
+			"s3.force-path-style",
+			"Use path-style S3 addressing (required by most S3-compatible stores)",
+		).Bool()
+
+		s3Insecure = kingpin.Flag(
+			"s3.insecure",
+			"Skip TLS certificate verification when talking to the S3 endpoint",
+		).Bool()
+
 		listenAddress = kingpin.Flag(
 			"web.listen-address",
 			"Address on which to expose metrics and web interface.",
@@ -152,24 +248,47 @@ func main() {
 			"web.config",
 			"[EXPERIMENTAL] Path to config yaml file that can enable TLS or authentication.",
 		).Default("").String()
+
+		logLevel = kingpin.Flag(
+			"log.level",
+			"Only log messages with the given severity or above. One of: [debug, info, warn, error]",
+		).Default("info").Enum("debug", "info", "warn", "error")
+
+		logFormat = kingpin.Flag(
+			"log.format",
+			"Output format of log messages. One of: [logfmt, json]",
+		).Default("logfmt").Enum("logfmt", "json")
 	)
 
-	promlogConfig := &promlog.Config{}
-	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.Version(version.Print("aws-cost-exporter"))
 	kingpin.CommandLine.UsageWriter(os.Stdout)
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 
-	logger := promlog.New(promlogConfig)
+	logger := newLogger(*logLevel, *logFormat)
 
-	level.Info(logger).Log("msg", "Starting aws-cost-exporter", "version", version.Info())
-	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
+	logger.Info("starting aws-cost-exporter", "version", version.Info())
+	logger.Info("build context", "build_context", version.BuildContext())
 	if user, err := user.Current(); err == nil && user.Uid == "0" {
-		level.Warn(logger).Log("msg", "AWS Cost Exporter is running as root user. This exporter is designed to run as unpriviledged user, root is not required.")
+		logger.Warn("AWS Cost Exporter is running as root user. This exporter is designed to run as unpriviledged user, root is not required.")
+	}
+
+	var accounts []state.Account
+	if *accountsConfigPath != "" {
+		loaded, err := state.LoadAccounts(*accountsConfigPath)
+		if err != nil {
+			logger.Error("failed to load accounts config", "err", err)
+			os.Exit(1)
+		}
+		accounts = loaded
+	} else if *bucketName == "" || *reportName == "" {
+		logger.Error("--bucket and --report are required unless --accounts-config is given")
+		os.Exit(1)
 	}
 
 	chainedRole, _ := os.LookupEnv("AWS_CHAINED_ROLE")
+	s3AccessKey, _ := os.LookupEnv("S3_ACCESS_KEY_ID")
+	s3SecretKey, _ := os.LookupEnv("S3_SECRET_ACCESS_KEY")
 
 	config := &state.Config{
 		RepositoryPath: *repositoryPath,
@@ -180,29 +299,43 @@ func main() {
 		BucketName: *bucketName,
 		ReportName: *reportName,
 		ChainedRole: chainedRole,
+		Accounts:    accounts,
+
+		IngestBatchSize:  *ingestBatchSize,
+		FetchConcurrency: *fetchConcurrency,
+
+		S3Endpoint:       *s3Endpoint,
+		S3Region:         *s3Region,
+		S3ForcePathStyle: *s3ForcePathStyle,
+		S3Insecure:       *s3Insecure,
+		S3AccessKey:      s3AccessKey,
+		S3SecretKey:      s3SecretKey,
 	}
 
 	state, err := state.Load(config)
 	if err != nil {
-		level.Error(logger).Log("err", err)
+		logger.Error("failed to load state", "err", err)
 		os.Exit(1)
 	}
 
-	level.Info(logger).Log("gatherer", "Starting")
-	gatherer, err := newGatherer(config, state, *disableExporterMetrics, logger)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("gatherer starting")
+	gatherer, err := newGatherer(ctx, config, state, *disableExporterMetrics, logger)
 	if err != nil {
-		level.Error(logger).Log("err", err)
+		logger.Error("failed to build gatherer", "err", err)
 		os.Exit(1)
 	}
 
-	level.Info(logger).Log("http-handler", "Starting")
+	logger.Info("http-handler starting")
 	http.Handle(*metricsPath, promhttp.HandlerFor(
 		gatherer,
 		promhttp.HandlerOpts{
 			EnableOpenMetrics: true,
 		},
 	))
-	level.Info(logger).Log("http-handler", "Started")
+	logger.Info("http-handler started")
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>AWS Cost Exporter</title></head>
@@ -213,10 +346,32 @@ func main() {
 			</html>`))
 	})
 
-	level.Info(logger).Log("msg", "Listening on", "address", *listenAddress)
+	logger.Info("listening on", "address", *listenAddress)
 	server := &http.Server{Addr: *listenAddress}
 	if err := web.ListenAndServe(server, *configFile, logger); err != nil {
-		level.Error(logger).Log("err", err)
+		logger.Error("failed to start http server", "err", err)
 		os.Exit(1)
 	}
 }
+
+// newLogger builds the exporter's root logger from the --log.level and
+// --log.format flags, defaulting to a text handler on stderr if handed an
+// unrecognised format (should not happen given the kingpin Enum above).
+func newLogger(logLevel, logFormat string) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch logFormat {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	return slog.New(handler)
+}
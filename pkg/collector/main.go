@@ -3,69 +3,115 @@ package collector
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/st8ed/aws-cost-exporter/pkg/fetcher"
+	"github.com/st8ed/aws-cost-exporter/pkg/metrics"
 	"github.com/st8ed/aws-cost-exporter/pkg/state"
 
-	"github.com/go-kit/log"
-	"github.com/go-kit/log/level"
+	"golang.org/x/sync/errgroup"
+
+	"context"
+	"log/slog"
+	"os"
 
 	"time"
 )
 
+// defaultFetchConcurrency is the number of billing periods fetched and
+// ingested concurrently when config.FetchConcurrency is unset.
+const defaultFetchConcurrency = 4
+
+// withDefault returns logger, or a stderr text-handler logger if logger is nil.
+func withDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	return logger
+}
+
+// Prefetch ensures every period has an up-to-date report ingested, fetching
+// whatever is missing or stale. Periods are fetched concurrently, bounded by
+// config.FetchConcurrency, so a slow report for one period doesn't delay the
+// others. account namespaces state.ReportLastModified in multi-account mode
+// and is empty otherwise.
 func Prefetch(
-	state *state.State,
+	ctx context.Context,
+	st *state.State,
 	config *state.Config,
 	registry *prometheus.Registry,
 	periods []state.BillingPeriod,
-	logger log.Logger,
+	logger *slog.Logger,
+	account string,
+	m *metrics.Metrics,
 ) error {
+	logger = withDefault(logger)
+
+	concurrency := config.FetchConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultFetchConcurrency
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+
 	for i, period := range periods {
+		period := period
 		isLast := (i == len(periods)-1)
-		_, isCached := state.ReportLastModified[string(period)]
+		_, isCached := st.LastModified(state.ReportKey(account, period))
 
 		if !isCached || isLast {
-			if _, err := UpdateReport(state, config, &period, logger); err != nil {
+			g.Go(func() error {
+				_, err := UpdateReport(gctx, st, config, &period, logger, account, m)
 				return err
-			}
+			})
 		}
 	}
 
-	return nil
+	return g.Wait()
 }
 
 func UpdateReport(
-	state *state.State, config *state.Config,
+	ctx context.Context,
+	st *state.State, config *state.Config,
 	period *state.BillingPeriod,
-	logger log.Logger,
+	logger *slog.Logger,
+	account string,
+	m *metrics.Metrics,
 ) (updated bool, err error) {
-	lastModified, ok := state.ReportLastModified[string(*period)]
+	logger = withDefault(logger)
+
+	key := state.ReportKey(account, *period)
+	lastModified, ok := st.LastModified(key)
 	if !ok {
 		lastModified = time.Time{}
 	}
 
-	level.Debug(logger).Log("msg", "Attempt to download new report manifest", "period", period, "lastModified", lastModified)
-	manifest, err := fetcher.GetReportManifest(config, period, &lastModified)
+	logger.Debug("attempt to download new report manifest", "period", period, "account", account, "lastModified", lastModified)
+	manifest, err := fetcher.GetReportManifest(ctx, config, period, &lastModified, logger, m)
 	if err != nil {
 		return false, err
 	}
 
 	if manifest == nil {
-		level.Debug(logger).Log("msg", "Report manifest didn't change", "period", period, "lastModified", lastModified)
+		logger.Debug("report manifest didn't change", "period", period, "account", account, "lastModified", lastModified)
 		return false, nil
 	}
 
-	level.Debug(logger).Log("msg", "Reset sqlite")
-	err = fetcher.ResetSqlite(config, logger)
+	logger.Debug("preparing sqlite")
+	err = fetcher.PrepareSqlite(ctx, config, logger)
 	if err != nil {
 		return false, err
 	}
 
-
-	level.Debug(logger).Log("msg", "Fetch report")
-	if err := fetcher.FetchReport(config, manifest, logger); err != nil {
+	logger.Debug("fetching report")
+	if err := fetcher.FetchReport(ctx, config, manifest, logger, m, string(*period), account); err != nil {
 		return false, err
 	}
 
-	state.ReportLastModified[string(*period)] = lastModified
+	st.SetLastModified(key, lastModified)
+	m.LastSuccessfulFetch.WithLabelValues(string(*period), account).Set(float64(time.Now().Unix()))
+
+	if info, err := os.Stat(config.DatabasePath); err == nil {
+		m.SqliteDBSize.WithLabelValues(account).Set(float64(info.Size()))
+	}
 
 	return true, nil
 }
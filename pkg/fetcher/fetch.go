@@ -1,6 +1,7 @@
 package fetcher
 
 import (
+	"github.com/st8ed/aws-cost-exporter/pkg/metrics"
 	"github.com/st8ed/aws-cost-exporter/pkg/state"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -10,8 +11,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	stsTypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
 
-	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,14 +22,15 @@ import (
 	"strings"
 	"math/rand"
 	"database/sql"
-	"encoding/csv"
 
 	_ "github.com/mattn/go-sqlite3"
 
-	"github.com/go-kit/log"
-	"github.com/go-kit/log/level"
+	"golang.org/x/sync/errgroup"
+
+	"log/slog"
 
 	"io"
+	"net/http"
 	"os"
 	"time"
 
@@ -47,6 +49,20 @@ type ReportManifest struct {
 	ReportKeys []string `json:"reportKeys"`
 }
 
+// AssumeRoleError wraps a failure to assume config.ChainedRole, so callers
+// fanning out across multiple accounts can tell an access/trust problem
+// with one payer's role apart from other failures and keep going.
+type AssumeRoleError struct {
+	RoleArn string
+	Err     error
+}
+
+func (e *AssumeRoleError) Error() string {
+	return fmt.Sprintf("assume role %s: %v", e.RoleArn, e.Err)
+}
+
+func (e *AssumeRoleError) Unwrap() error { return e.Err }
+
 type SortRecentFirst []state.BillingPeriod
 
 func (a SortRecentFirst) Len() int           { return len(a) }
@@ -61,11 +77,62 @@ func index(slice []string, item string) int {
 	return -1
 }
 
-func RefreshClient(config *state.Config) (*s3.Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1 * time.Minute)
+// withDefault returns logger, or a stderr text-handler logger if logger is nil.
+func withDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	return logger
+}
+
+// s3ConfigOptions builds the aws-sdk-go-v2 config.LoadOptions shared by both
+// the source-account and assumed-role clients, threading through the
+// S3-compatible endpoint settings (MinIO, Ceph RGW, R2, ...).
+func s3ConfigOptions(config *state.Config) []func(*awsconfig.LoadOptions) error {
+	region := "us-east-1"
+	if config.S3Region != "" {
+		region = config.S3Region
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithDefaultRegion(region)}
+
+	if config.S3Endpoint != "" {
+		opts = append(opts, awsconfig.WithEndpointResolverWithOptions(
+			aws.EndpointResolverWithOptionsFunc(func(service, region string, _ ...interface{}) (aws.Endpoint, error) {
+				return aws.Endpoint{
+					URL:               config.S3Endpoint,
+					SigningRegion:     region,
+					HostnameImmutable: true,
+					Source:            aws.EndpointSourceCustom,
+				}, nil
+			}),
+		))
+	}
+
+	if config.S3Insecure {
+		opts = append(opts, awsconfig.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}))
+	}
+
+	return opts
+}
+
+func RefreshClient(ctx context.Context, config *state.Config) (*s3.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	defer cancel()
 
-	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithDefaultRegion("us-east-1"))
+	opts := s3ConfigOptions(config)
+
+	if config.S3AccessKey != "" || config.S3SecretKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(config.S3AccessKey, config.S3SecretKey, ""),
+		))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -75,28 +142,37 @@ func RefreshClient(config *state.Config) (*s3.Client, error) {
 
 		// Assume target role and store credentials
 		rand.Seed(time.Now().UnixNano())
-		response, err := sourceAccount.AssumeRole(ctx, &sts.AssumeRoleInput{
-				RoleArn: aws.String(config.ChainedRole),
-				RoleSessionName: aws.String("AWSCostExporter-" + strconv.Itoa(10000 + rand.Intn(25000))),
-		})
+		assumeRoleInput := &sts.AssumeRoleInput{
+			RoleArn:         aws.String(config.ChainedRole),
+			RoleSessionName: aws.String("AWSCostExporter-" + strconv.Itoa(10000+rand.Intn(25000))),
+		}
+		if config.ExternalID != "" {
+			assumeRoleInput.ExternalId = aws.String(config.ExternalID)
+		}
+
+		response, err := sourceAccount.AssumeRole(ctx, assumeRoleInput)
 		if err != nil {
-			return nil, err
+			return nil, &AssumeRoleError{RoleArn: config.ChainedRole, Err: err}
 		}
 		var assumedRoleCreds *stsTypes.Credentials = response.Credentials
 
 		// Create config with target service client, using assumed role
-		cfg, err = awsconfig.LoadDefaultConfig(ctx, awsconfig.WithDefaultRegion("us-east-1"),
-																				awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*assumedRoleCreds.AccessKeyId, *assumedRoleCreds.SecretAccessKey, *assumedRoleCreds.SessionToken)))
+		cfg, err = awsconfig.LoadDefaultConfig(ctx, append(s3ConfigOptions(config),
+			awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*assumedRoleCreds.AccessKeyId, *assumedRoleCreds.SecretAccessKey, *assumedRoleCreds.SessionToken)))...)
 		if err != nil {
 			return nil, err
 		}
 
 	}
-	return s3.NewFromConfig(cfg), nil
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if config.S3ForcePathStyle {
+			o.UsePathStyle = true
+		}
+	}), nil
 }
 
-func GetBillingPeriods(config *state.Config) ([]state.BillingPeriod, error) {
-	client, err := RefreshClient(config)
+func GetBillingPeriods(ctx context.Context, config *state.Config) ([]state.BillingPeriod, error) {
+	client, err := RefreshClient(ctx, config)
 	if err != nil {
 		return nil, err
 	}
@@ -110,7 +186,7 @@ func GetBillingPeriods(config *state.Config) ([]state.BillingPeriod, error) {
 	p := s3.NewListObjectsV2Paginator(client, params)
 
 	for p.HasMorePages() {
-		page, err := p.NextPage(context.TODO())
+		page, err := p.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -137,8 +213,13 @@ func GetBillingPeriods(config *state.Config) ([]state.BillingPeriod, error) {
 	}
 }
 
-func GetReportManifest(config *state.Config, period *state.BillingPeriod, lastModified *time.Time) (*ReportManifest, error) {
-	client, err := RefreshClient(config)
+func GetReportManifest(ctx context.Context, config *state.Config, period *state.BillingPeriod, lastModified *time.Time, logger *slog.Logger, m *metrics.Metrics) (*ReportManifest, error) {
+	logger = withDefault(logger)
+
+	start := time.Now()
+	defer func() { m.FetchDuration.WithLabelValues("manifest").Observe(time.Since(start).Seconds()) }()
+
+	client, err := RefreshClient(ctx, config)
 	if err != nil {
 		return nil, err
 	}
@@ -151,20 +232,25 @@ func GetReportManifest(config *state.Config, period *state.BillingPeriod, lastMo
 		IfModifiedSince: aws.Time(*lastModified),
 	}
 
-	obj, err := client.GetObject(context.TODO(), params)
+	obj, err := client.GetObject(ctx, params)
 	if err != nil {
 		var ae smithy.APIError
 
 		if !errors.As(err, &ae) {
+			m.S3APICalls.WithLabelValues("GetObject", "error").Inc()
 			return nil, err
 		}
 
 		if ae.ErrorCode() == "NotModified" {
+			m.S3APICalls.WithLabelValues("GetObject", "not_modified").Inc()
+			logger.Debug("report manifest not modified", "period", period, "lastModified", lastModified)
 			return nil, nil
 		} else {
+			m.S3APICalls.WithLabelValues("GetObject", "error").Inc()
 			return nil, err
 		}
 	}
+	m.S3APICalls.WithLabelValues("GetObject", "success").Inc()
 	defer obj.Body.Close()
 
 	*lastModified = *obj.LastModified
@@ -175,7 +261,11 @@ func GetReportManifest(config *state.Config, period *state.BillingPeriod, lastMo
 		return nil, err
 	}
 
-	if manifest.ContentType != "text/csv" {
+	logger.Info("fetched report manifest", "period", period, "assemblyId", manifest.AssemblyId)
+
+	// An empty content type is accepted: newReportReader then picks the
+	// format from each report key's extension.
+	if manifest.ContentType != "" && manifest.ContentType != "text/csv" && manifest.ContentType != "application/x-parquet" {
 		return nil, fmt.Errorf("report manifest contains unknown content type: %s", manifest.ContentType)
 	}
 
@@ -190,147 +280,314 @@ func GetReportManifest(config *state.Config, period *state.BillingPeriod, lastMo
 	return manifest, nil
 }
 
-func FetchReport(config *state.Config, manifest *ReportManifest, logger log.Logger) error {
-	client, err := RefreshClient(config)
+// defaultIngestBatchSize is the number of rows committed per transaction
+// when config.IngestBatchSize is unset.
+const defaultIngestBatchSize = 1000
+
+// defaultFetchConcurrency is the number of report parts downloaded and
+// parsed concurrently when config.FetchConcurrency is unset.
+const defaultFetchConcurrency = 4
+
+const insertRecordSQL = `insert into records (bill_BillingPeriodStartDate,
+	bill_BillingPeriodEndDate, product_ProductName, lineItem_Operation, lineItem_UnblendedCost, lineItem_UsageAccountId,
+	lineItem_LineItemType, lineItem_UsageType, lineItem_UsageAmount, pricing_unit, lineItem_CurrencyCode)
+	values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+func FetchReport(ctx context.Context, config *state.Config, manifest *ReportManifest, logger *slog.Logger, m *metrics.Metrics, period, account string) error {
+	logger = withDefault(logger)
+
+	periodStart, err := time.Parse("20060102T150405Z", manifest.BillingPeriod.Start)
 	if err != nil {
 		return err
 	}
-	periodStart, err := time.Parse("20060102T150405Z", manifest.BillingPeriod.Start)
+	periodEnd, err := time.Parse("20060102T150405Z", manifest.BillingPeriod.End)
 	if err != nil {
 		return err
 	}
 
-	for reportPart, reportKey := range manifest.ReportKeys {
+	db, err := sql.Open("sqlite3", config.DatabasePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			logger.Warn("unable to close database", "err", err)
+		}
+		logger.Debug("closed database")
+	}()
+
+	for _, pragma := range []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA synchronous=NORMAL",
+		"PRAGMA temp_store=MEMORY",
+		// Prefetch fans out across billing periods concurrently, and each
+		// period's FetchReport opens its own connection to the same
+		// database file; without a busy timeout, the writer that loses the
+		// race for sqlite's single write lock fails immediately with
+		// "database is locked" instead of waiting for its turn.
+		"PRAGMA busy_timeout=30000",
+	} {
+		if _, err := db.Exec(pragma); err != nil {
+			return err
+		}
+	}
+
+	batchSize := config.IngestBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultIngestBatchSize
+	}
 
+	concurrency := config.FetchConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultFetchConcurrency
+	}
+
+	type reportPart struct {
+		index int
+		key   string
+		file  string
+	}
+
+	var pending []reportPart
+	for index, reportKey := range manifest.ReportKeys {
 		reportFile := filepath.Join(
 			config.RepositoryPath, "data",
-			periodStart.Format("20060102")+"-"+manifest.AssemblyId+"-"+strconv.FormatInt(int64(reportPart), 10)+".csv",
+			periodStart.Format("20060102")+"-"+manifest.AssemblyId+"-"+strconv.FormatInt(int64(index), 10)+".csv",
 		)
-		level.Info(logger).Log("msg", "Fetching report part", "file", reportFile, "part", reportPart)
+		logger.Info("fetching report part", "file", reportFile, "part", index)
 		if _, err := os.Stat(reportFile); !errors.Is(err, os.ErrNotExist) {
-			level.Warn(logger).Log("msg", "Report file part already exists, skipping download", "file", reportFile)
+			logger.Warn("report file part already exists, skipping download", "file", reportFile)
 			continue
 		}
 
-		params := &s3.GetObjectInput{
-			Bucket: aws.String(manifest.Bucket),
-			Key:    aws.String(reportKey),
-		}
-
-		obj, err := client.GetObject(context.TODO(), params)
-		if err != nil {
-			return err
-		}
-		defer obj.Body.Close()
+		pending = append(pending, reportPart{index: index, key: reportKey, file: reportFile})
+	}
 
-		level.Debug(logger).Log("ContentLength", obj.ContentLength)
+	if len(pending) == 0 {
+		return nil
+	}
 
-		zr, err := gzip.NewReader(obj.Body)
-		if err != nil {
+	// No part's marker file survived, so this is either the first ingest of
+	// this period or a re-ingest under a new assembly (new assemblies get
+	// new marker filenames, so none of their parts are ever skipped above).
+	// Either way, any rows already in the table for this period are from a
+	// stale assembly and must be cleared before we ingest its replacement,
+	// or the new rows land on top of the old ones and double every metric
+	// for this period. A partial resume of the *same* assembly (some marker
+	// files already present) skips this, since those rows belong to the
+	// assembly we're continuing to ingest.
+	if len(pending) == len(manifest.ReportKeys) {
+		if _, err := db.ExecContext(ctx, "DELETE FROM records WHERE bill_BillingPeriodStartDate = ? AND bill_BillingPeriodEndDate = ?",
+			periodStart.Format(time.RFC3339), periodEnd.Format(time.RFC3339),
+		); err != nil {
 			return err
 		}
-		defer zr.Close()
+	}
 
-		r := csv.NewReader(zr)
-		// Read the header row.
-		header, err := r.Read()
-		if err != nil {
-			return err
-		}
-		bill_BillingPeriodStartDate := index(header, "bill/BillingPeriodStartDate")
-		bill_BillingPeriodEndDate := index(header, "bill/BillingPeriodEndDate")
-		product_ProductName := index(header, "product/ProductName")
-		lineItem_Operation := index(header, "lineItem/Operation")
-		lineItem_LineItemType := index(header, "lineItem/LineItemType")
-		lineItem_UsageType := index(header, "lineItem/UsageType")
-		lineItem_UsageAmount := index(header, "lineItem/UsageAmount")
-		pricing_unit := index(header, "pricing/unit")
-		lineItem_CurrencyCode := index(header, "lineItem/CurrencyCode")
-		lineItem_UnblendedCost := index(header, "lineItem/UnblendedCost")
-		lineItem_UsageAccountId := index(header, "lineItem/UsageAccountId")
-
-		db, err := sql.Open("sqlite3", config.DatabasePath)
-		if err != nil {
-			return err
-		}
-		defer func() {
-			if err := db.Close(); err != nil {
-				level.Warn(logger).Log("msg", "Unable to close database", "err", err)
-			}
-			level.Debug(logger).Log("msg", "Closed database")
-		}()
-
-		ctx, cancel := context.WithTimeout(context.Background(), 15 * time.Minute)
-		defer cancel()
-
-    tx, err := db.BeginTx(ctx, nil)
-    if err != nil {
-        return err
-    }
-    defer tx.Rollback()
-		for {
-			record, err := r.Read()
-			if errors.Is(err, io.EOF) {
-				break
+	// Every concurrent downloader streams its records into this channel;
+	// ingestStream is the single writer draining it, since sqlite tolerates
+	// only one writer at a time.
+	records := make(chan *record, batchSize)
+
+	// writerCtx is canceled as soon as the writer goroutine returns, for any
+	// reason. Without this, a downloader blocked on "records <- rec" after
+	// ingestStream has already given up (e.g. on an insert error) would
+	// never see its send unblocked, and g.Wait() would hang forever.
+	writerCtx, cancelWriter := context.WithCancel(ctx)
+	defer cancelWriter()
+
+	g, gctx := errgroup.WithContext(writerCtx)
+	g.SetLimit(concurrency)
+
+	var ingested int64
+	writerDone := make(chan error, 1)
+	go func() {
+		defer cancelWriter()
+		start := time.Now()
+		rows, err := ingestStream(gctx, db, records, batchSize, logger)
+		m.FetchDuration.WithLabelValues("ingest").Observe(time.Since(start).Seconds())
+		ingested = rows
+		writerDone <- err
+	}()
+
+	for _, part := range pending {
+		part := part
+		g.Go(func() error {
+			downloadStart := time.Now()
+
+			// Each worker needs its own client: aws-sdk-go-v2 clients are
+			// safe for concurrent use, but assumed-role credentials are
+			// refreshed independently per worker to avoid one worker's
+			// retry storm blocking another's.
+			client, err := RefreshClient(gctx, config)
+			if err != nil {
+				return err
 			}
 
-			level.Debug(logger).Log("SQLite", "Inserting record", record[lineItem_UsageAccountId])
-
-			stmt, err := tx.Prepare(`insert into records (bill_BillingPeriodStartDate,
-				bill_BillingPeriodEndDate, product_ProductName, lineItem_Operation, lineItem_UnblendedCost, lineItem_UsageAccountId,
-				lineItem_LineItemType, lineItem_UsageType, lineItem_UsageAmount, pricing_unit, lineItem_CurrencyCode)
-				values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+			obj, err := client.GetObject(gctx, &s3.GetObjectInput{
+				Bucket: aws.String(manifest.Bucket),
+				Key:    aws.String(part.key),
+			})
 			if err != nil {
+				m.S3APICalls.WithLabelValues("GetObject", "error").Inc()
 				return err
 			}
+			m.S3APICalls.WithLabelValues("GetObject", "success").Inc()
+			defer obj.Body.Close()
+
+			if obj.ContentLength > 0 {
+				m.BytesDownloaded.Add(float64(obj.ContentLength))
+			}
+			m.FetchDuration.WithLabelValues("download").Observe(time.Since(downloadStart).Seconds())
+
+			logger.Debug("downloaded report part", "file", part.file, "contentLength", obj.ContentLength)
 
-			_, err = stmt.Exec(record[bill_BillingPeriodStartDate],
-												 record[bill_BillingPeriodEndDate],
-												 record[product_ProductName],
-												 record[lineItem_Operation],
-												 record[lineItem_UnblendedCost],
-												 record[lineItem_UsageAccountId],
-												 record[lineItem_LineItemType],
-												 record[lineItem_UsageType],
-												 record[lineItem_UsageAmount],
-												 record[pricing_unit],
-												 record[lineItem_CurrencyCode])
+			rr, err := newReportReader(manifest.ContentType, part.key, obj.Body)
 			if err != nil {
 				return err
 			}
-		}
-		level.Debug(logger).Log("Report", "File done", reportFile)
-		file, err := os.Create(reportFile)
-		if err != nil {
-				return err
-		}
-		defer file.Close()
+			defer rr.Close()
+
+			for {
+				rec, err := rr.Read()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					return err
+				}
+
+				select {
+				case records <- rec:
+				case <-gctx.Done():
+					return gctx.Err()
+				}
+			}
+
+			return nil
+		})
+	}
+
+	fetchErr := g.Wait()
+	close(records)
+	writerErr := <-writerDone
 
-    if err = tx.Commit(); err != nil {
+	// Prefer the writer's error: if it failed first, fetchErr is usually
+	// just the downloaders unblocking from the canceled writerCtx above,
+	// which is far less useful to the caller than the real cause.
+	if writerErr != nil {
+		return writerErr
+	}
+	if fetchErr != nil {
+		return fetchErr
+	}
+
+	logger.Debug("report parts ingested", "parts", len(pending), "rows", ingested)
+	m.RowsIngested.WithLabelValues(period, account).Add(float64(ingested))
+
+	for _, part := range pending {
+		file, err := os.Create(part.file)
+		if err != nil {
 			return err
 		}
+		file.Close()
 	}
+
 	return nil
 }
 
-func PrepareSqlite(config *state.Config, logger log.Logger) error {
+// ingestStream commits records arriving on recs into the records table,
+// preparing the insert statement once and committing every batchSize rows so
+// a multi-GB CUR doesn't hold a single transaction's WAL open for the whole
+// ingest. It is FetchReport's single writer: every concurrent downloader's
+// parsed rows are funnelled through this one goroutine, since sqlite only
+// tolerates one writer at a time.
+func ingestStream(ctx context.Context, db *sql.DB, recs <-chan *record, batchSize int, logger *slog.Logger) (int64, error) {
+	var total int64
+
+	tx, stmt, err := beginBatch(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsInBatch := 0
+	for rec := range recs {
+		logger.Debug("inserting record", "usageAccountId", rec.lineItemUsageAccountId)
+
+		if _, err := stmt.ExecContext(ctx, rec.values()...); err != nil {
+			tx.Rollback()
+			return total, err
+		}
+
+		total++
+		rowsInBatch++
+
+		if rowsInBatch >= batchSize {
+			if err := stmt.Close(); err != nil {
+				tx.Rollback()
+				return total, err
+			}
+			if err := tx.Commit(); err != nil {
+				return total, err
+			}
+
+			tx, stmt, err = beginBatch(ctx, db)
+			if err != nil {
+				return total, err
+			}
+			rowsInBatch = 0
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		tx.Rollback()
+		return total, err
+	}
+	if err := tx.Commit(); err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
+
+func beginBatch(ctx context.Context, db *sql.DB) (*sql.Tx, *sql.Stmt, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stmt, err := tx.Prepare(insertRecordSQL)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+
+	return tx, stmt, nil
+}
+
+func PrepareSqlite(ctx context.Context, config *state.Config, logger *slog.Logger) error {
+	logger = withDefault(logger)
+
 	db, err := sql.Open("sqlite3", config.DatabasePath)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	err = db.Ping()
+	err = db.PingContext(ctx)
 	if err != nil {
 		return err
 	}
-	stmt, err := db.Prepare(`create table if not exists records (id integer primary key autoincrement, bill_BillingPeriodStartDate text,
+	if _, err := db.ExecContext(ctx, "PRAGMA busy_timeout=30000"); err != nil {
+		return err
+	}
+	stmt, err := db.PrepareContext(ctx, `create table if not exists records (id integer primary key autoincrement, bill_BillingPeriodStartDate text,
 														bill_BillingPeriodEndDate text, product_ProductName text,
 														lineItem_Operation text, lineItem_UnblendedCost text, lineItem_UsageAccountId text,
 														lineItem_LineItemType text, lineItem_UsageType text, lineItem_UsageAmount text, pricing_unit text, lineItem_CurrencyCode text)`)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec()
+	_, err = stmt.ExecContext(ctx)
 	if err != nil {
 		return err
 	}
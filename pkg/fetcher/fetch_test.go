@@ -0,0 +1,165 @@
+package fetcher
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// TestIngestStreamError exercises the single-writer's error path: when the
+// insert statement can't be prepared, ingestStream must return the error,
+// with no rows committed, rather than swallowing it or hanging.
+func TestIngestStreamError(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database.sqlite")
+	config := &state.Config{DatabasePath: dbPath}
+
+	if err := PrepareSqlite(context.Background(), config, testLogger()); err != nil {
+		t.Fatalf("PrepareSqlite: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	// Dropping the table after it's created, but before ingestStream runs,
+	// makes preparing the insert fail without needing a malformed record.
+	if _, err := db.Exec("drop table records"); err != nil {
+		t.Fatalf("drop table: %v", err)
+	}
+
+	records := make(chan *record, 1)
+	records <- &record{billBillingPeriodStartDate: "2023-01-01T00:00:00Z"}
+	close(records)
+
+	rows, err := ingestStream(context.Background(), db, records, defaultIngestBatchSize, testLogger())
+	if err == nil {
+		t.Fatal("expected ingestStream to return an error when the records table doesn't exist")
+	}
+	if rows != 0 {
+		t.Fatalf("expected 0 rows committed on a failed insert, got %d", rows)
+	}
+}
+
+// TestIngestStreamCommitsBatches confirms the happy path: all records sent
+// on the channel are visible once the channel is closed and ingestStream
+// returns.
+func TestIngestStreamCommitsBatches(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database.sqlite")
+	config := &state.Config{DatabasePath: dbPath}
+
+	if err := PrepareSqlite(context.Background(), config, testLogger()); err != nil {
+		t.Fatalf("PrepareSqlite: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	records := make(chan *record, 3)
+	for i := 0; i < 3; i++ {
+		records <- &record{billBillingPeriodStartDate: "2023-01-01T00:00:00Z"}
+	}
+	close(records)
+
+	rows, err := ingestStream(context.Background(), db, records, 2, testLogger())
+	if err != nil {
+		t.Fatalf("ingestStream: %v", err)
+	}
+	if rows != 3 {
+		t.Fatalf("expected 3 rows ingested, got %d", rows)
+	}
+
+	var count int
+	if err := db.QueryRow("select count(*) from records").Scan(&count); err != nil {
+		t.Fatalf("count query: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 rows in table, got %d", count)
+	}
+}
+
+// TestConcurrentIngestDoesNotLock exercises the scenario from Prefetch: four
+// writers, each with their own *sql.DB connection, ingesting into the same
+// sqlite file at once. Without PRAGMA busy_timeout (set by PrepareSqlite and
+// FetchReport), the loser of sqlite's single-writer lock fails immediately
+// with "database is locked" instead of waiting its turn.
+func TestConcurrentIngestDoesNotLock(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "database.sqlite")
+	config := &state.Config{DatabasePath: dbPath}
+
+	if err := PrepareSqlite(context.Background(), config, testLogger()); err != nil {
+		t.Fatalf("PrepareSqlite: %v", err)
+	}
+
+	const writers = 4
+	const recordsPerWriter = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			db, err := sql.Open("sqlite3", dbPath)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+
+			if _, err := db.Exec("PRAGMA busy_timeout=30000"); err != nil {
+				errs <- err
+				return
+			}
+
+			records := make(chan *record, recordsPerWriter)
+			for i := 0; i < recordsPerWriter; i++ {
+				records <- &record{billBillingPeriodStartDate: "2023-01-01T00:00:00Z"}
+			}
+			close(records)
+
+			if _, err := ingestStream(context.Background(), db, records, 10, testLogger()); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("concurrent ingest failed: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("select count(*) from records").Scan(&count); err != nil {
+		t.Fatalf("count query: %v", err)
+	}
+	if count != writers*recordsPerWriter {
+		t.Fatalf("expected %d rows, got %d", writers*recordsPerWriter, count)
+	}
+}
@@ -0,0 +1,237 @@
+package fetcher
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	parquetsource "github.com/xitongsys/parquet-go-source/buffer"
+	parquetreader "github.com/xitongsys/parquet-go/reader"
+)
+
+// curColumns lists the CUR columns this exporter ingests, in the order the
+// `records` table expects them.
+var curColumns = []string{
+	"bill/BillingPeriodStartDate",
+	"bill/BillingPeriodEndDate",
+	"product/ProductName",
+	"lineItem/Operation",
+	"lineItem/UnblendedCost",
+	"lineItem/UsageAccountId",
+	"lineItem/LineItemType",
+	"lineItem/UsageType",
+	"lineItem/UsageAmount",
+	"pricing/unit",
+	"lineItem/CurrencyCode",
+}
+
+// record is a single normalized CUR line item, independent of the
+// underlying wire format (gzipped CSV or CUR 2.0 Parquet).
+type record struct {
+	billBillingPeriodStartDate string
+	billBillingPeriodEndDate   string
+	productProductName         string
+	lineItemOperation          string
+	lineItemUnblendedCost      string
+	lineItemUsageAccountId     string
+	lineItemLineItemType       string
+	lineItemUsageType          string
+	lineItemUsageAmount        string
+	pricingUnit                string
+	lineItemCurrencyCode       string
+}
+
+func (r *record) values() []interface{} {
+	return []interface{}{
+		r.billBillingPeriodStartDate, r.billBillingPeriodEndDate, r.productProductName,
+		r.lineItemOperation, r.lineItemUnblendedCost, r.lineItemUsageAccountId,
+		r.lineItemLineItemType, r.lineItemUsageType, r.lineItemUsageAmount,
+		r.pricingUnit, r.lineItemCurrencyCode,
+	}
+}
+
+// reportReader streams normalized records out of a single CUR report part.
+// Read returns io.EOF once the part is exhausted.
+type reportReader interface {
+	Read() (*record, error)
+	Close() error
+}
+
+// isParquet reports whether a CUR report part is CUR 2.0 Parquet rather
+// than the legacy gzipped CSV export, based on the manifest content type
+// (falling back to the object key extension for manifests that omit it).
+func isParquet(contentType, reportKey string) bool {
+	if contentType == "application/x-parquet" {
+		return true
+	}
+	return strings.HasSuffix(reportKey, ".parquet") || strings.HasSuffix(reportKey, ".snappy.parquet")
+}
+
+// newReportReader picks the reportReader implementation for a report part
+// based on its format, so FetchReport doesn't need to know the difference
+// between CUR 1.0 CSV and CUR 2.0 Parquet exports.
+func newReportReader(contentType, reportKey string, body io.Reader) (reportReader, error) {
+	if isParquet(contentType, reportKey) {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		return newParquetReportReader(data)
+	}
+
+	return newCSVReportReader(body)
+}
+
+type csvReportReader struct {
+	gz      *gzip.Reader
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func newCSVReportReader(body io.Reader) (*csvReportReader, error) {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := csv.NewReader(gz)
+	header, err := r.Read()
+	if err != nil {
+		gz.Close()
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(curColumns))
+	for _, name := range curColumns {
+		columns[name] = index(header, name)
+	}
+
+	return &csvReportReader{gz: gz, r: r, columns: columns}, nil
+}
+
+func (c *csvReportReader) Read() (*record, error) {
+	row, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	return &record{
+		billBillingPeriodStartDate: row[c.columns["bill/BillingPeriodStartDate"]],
+		billBillingPeriodEndDate:   row[c.columns["bill/BillingPeriodEndDate"]],
+		productProductName:         row[c.columns["product/ProductName"]],
+		lineItemOperation:          row[c.columns["lineItem/Operation"]],
+		lineItemUnblendedCost:      row[c.columns["lineItem/UnblendedCost"]],
+		lineItemUsageAccountId:     row[c.columns["lineItem/UsageAccountId"]],
+		lineItemLineItemType:       row[c.columns["lineItem/LineItemType"]],
+		lineItemUsageType:          row[c.columns["lineItem/UsageType"]],
+		lineItemUsageAmount:        row[c.columns["lineItem/UsageAmount"]],
+		pricingUnit:                row[c.columns["pricing/unit"]],
+		lineItemCurrencyCode:       row[c.columns["lineItem/CurrencyCode"]],
+	}, nil
+}
+
+func (c *csvReportReader) Close() error {
+	c.gz.Close()
+	return nil
+}
+
+// parquetColumns maps the camelCase/slash CUR 1.0 names listed in curColumns
+// to CUR 2.0's snake_case Parquet column names.
+var parquetColumns = map[string]string{
+	"bill/BillingPeriodStartDate": "bill_billing_period_start_date",
+	"bill/BillingPeriodEndDate":   "bill_billing_period_end_date",
+	"product/ProductName":         "product_product_name",
+	"lineItem/Operation":          "line_item_operation",
+	"lineItem/UnblendedCost":      "line_item_unblended_cost",
+	"lineItem/UsageAccountId":     "line_item_usage_account_id",
+	"lineItem/LineItemType":       "line_item_line_item_type",
+	"lineItem/UsageType":          "line_item_usage_type",
+	"lineItem/UsageAmount":        "line_item_usage_amount",
+	"pricing/unit":                "pricing_unit",
+	"lineItem/CurrencyCode":       "line_item_currency_code",
+}
+
+// parquetReportReader reads CUR 2.0 Parquet report parts row-by-row using a
+// schema-less reader, since the exact set of CUR columns varies by account
+// configuration.
+type parquetReportReader struct {
+	pr    *parquetreader.ParquetReader
+	row   int64
+	total int64
+}
+
+func newParquetReportReader(data []byte) (*parquetReportReader, error) {
+	pf, err := parquetsource.NewBufferFileFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := parquetreader.NewParquetReader(pf, nil, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parquetReportReader{pr: pr, total: pr.GetNumRows()}, nil
+}
+
+func (p *parquetReportReader) Read() (*record, error) {
+	if p.row >= p.total {
+		return nil, io.EOF
+	}
+
+	rows, err := p.pr.ReadByNumber(1)
+	if err != nil {
+		return nil, err
+	}
+	p.row++
+
+	fields, ok := rows[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected parquet row type %T", rows[0])
+	}
+
+	// get stringifies a Parquet field. Numeric CUR columns like
+	// lineItem/UnblendedCost and lineItem/UsageAmount decode as float64 (or
+	// occasionally int64), not string, so a plain type assertion silently
+	// yielded "" for every cost/amount.
+	get := func(curColumn string) string {
+		switch v := fields[parquetColumns[curColumn]].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case float32:
+			return strconv.FormatFloat(float64(v), 'f', -1, 32)
+		case int64:
+			return strconv.FormatInt(v, 10)
+		case int32:
+			return strconv.FormatInt(int64(v), 10)
+		case nil:
+			return ""
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+
+	return &record{
+		billBillingPeriodStartDate: get("bill/BillingPeriodStartDate"),
+		billBillingPeriodEndDate:   get("bill/BillingPeriodEndDate"),
+		productProductName:         get("product/ProductName"),
+		lineItemOperation:          get("lineItem/Operation"),
+		lineItemUnblendedCost:      get("lineItem/UnblendedCost"),
+		lineItemUsageAccountId:     get("lineItem/UsageAccountId"),
+		lineItemLineItemType:       get("lineItem/LineItemType"),
+		lineItemUsageType:          get("lineItem/UsageType"),
+		lineItemUsageAmount:        get("lineItem/UsageAmount"),
+		pricingUnit:                get("pricing/unit"),
+		lineItemCurrencyCode:       get("lineItem/CurrencyCode"),
+	}, nil
+}
+
+func (p *parquetReportReader) Close() error {
+	p.pr.ReadStop()
+	return nil
+}
@@ -0,0 +1,146 @@
+// Package metrics holds the exporter's self-observability collectors:
+// metrics describing the health of its own fetch/ingest pipeline, as opposed
+// to the billing metrics produced by pkg/processor from the ingested CUR
+// itself. Without these, operators have no way to tell a stalled ingest
+// (e.g. GetReportManifest quietly returning nil on NotModified forever) from
+// a payer that genuinely has nothing new to report.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics holds the exporter's self-observability collectors.
+type Metrics struct {
+	LastSuccessfulFetch *prometheus.GaugeVec
+	BytesDownloaded     prometheus.Counter
+	RowsIngested        *prometheus.CounterVec
+	S3APICalls          *prometheus.CounterVec
+	SqliteDBSize        *prometheus.GaugeVec
+	FetchDuration       *prometheus.HistogramVec
+}
+
+// New registers the self-observability collectors on registry. Calling New
+// more than once against the same registry reuses the collectors already
+// registered by an earlier call instead of panicking on the duplicate metric
+// name.
+func New(registry *prometheus.Registry) (*Metrics, error) {
+	lastSuccessfulFetch, err := registerGaugeVec(registry, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_cost_exporter_last_successful_fetch_timestamp_seconds",
+		Help: "Unix timestamp of the last time a billing period's report was successfully fetched and ingested.",
+	}, []string{"period", "account"}))
+	if err != nil {
+		return nil, err
+	}
+
+	bytesDownloaded, err := registerCounter(registry, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "aws_cost_exporter_report_bytes_downloaded_total",
+		Help: "Total number of bytes downloaded from report part objects.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	rowsIngested, err := registerCounterVec(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_cost_exporter_report_rows_ingested_total",
+		Help: "Total number of CUR rows ingested into sqlite, by billing period and account.",
+	}, []string{"period", "account"}))
+	if err != nil {
+		return nil, err
+	}
+
+	s3APICalls, err := registerCounterVec(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_cost_exporter_s3_api_calls_total",
+		Help: "Total number of S3 API calls made, by operation and result.",
+	}, []string{"operation", "result"}))
+	if err != nil {
+		return nil, err
+	}
+
+	sqliteDBSize, err := registerGaugeVec(registry, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_cost_exporter_sqlite_db_size_bytes",
+		Help: "Size in bytes of the sqlite database file backing an account's ingested CUR.",
+	}, []string{"account"}))
+	if err != nil {
+		return nil, err
+	}
+
+	fetchDuration, err := registerHistogramVec(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "aws_cost_exporter_fetch_duration_seconds",
+		Help: "Time spent in each stage of the fetch/ingest pipeline.",
+		// download/ingest/compute routinely take minutes on multi-GB CURs,
+		// well past prometheus.DefBuckets' 10s ceiling; reach into the
+		// tens-of-minutes range so slow stages don't all collapse into +Inf.
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"stage"}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Metrics{
+		LastSuccessfulFetch: lastSuccessfulFetch,
+		BytesDownloaded:     bytesDownloaded,
+		RowsIngested:        rowsIngested,
+		S3APICalls:          s3APICalls,
+		SqliteDBSize:        sqliteDBSize,
+		FetchDuration:       fetchDuration,
+	}, nil
+}
+
+func registerGaugeVec(registry *prometheus.Registry, gauge *prometheus.GaugeVec) (*prometheus.GaugeVec, error) {
+	if err := registry.Register(gauge); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.GaugeVec)
+		if !ok {
+			return nil, err
+		}
+		return existing, nil
+	}
+	return gauge, nil
+}
+
+func registerCounter(registry *prometheus.Registry, counter prometheus.Counter) (prometheus.Counter, error) {
+	if err := registry.Register(counter); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		existing, ok := are.ExistingCollector.(prometheus.Counter)
+		if !ok {
+			return nil, err
+		}
+		return existing, nil
+	}
+	return counter, nil
+}
+
+func registerCounterVec(registry *prometheus.Registry, counter *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	if err := registry.Register(counter); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.CounterVec)
+		if !ok {
+			return nil, err
+		}
+		return existing, nil
+	}
+	return counter, nil
+}
+
+func registerHistogramVec(registry *prometheus.Registry, histogram *prometheus.HistogramVec) (*prometheus.HistogramVec, error) {
+	if err := registry.Register(histogram); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.HistogramVec)
+		if !ok {
+			return nil, err
+		}
+		return existing, nil
+	}
+	return histogram, nil
+}
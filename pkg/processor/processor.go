@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/metrics"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"log/slog"
+)
+
+// Compute runs every *.sql query found in config.QueriesPath against the
+// ingested billing database and registers its result as a gauge vector
+// named after the query file, labelled by the query's non-value columns.
+// In multi-account mode, account is the owning account's name and is added
+// to every gauge as an extra "account" label; it is empty otherwise.
+func Compute(config *state.Config, registry *prometheus.Registry, logger *slog.Logger, account string, m *metrics.Metrics) error {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+
+	start := time.Now()
+	defer func() { m.FetchDuration.WithLabelValues("compute").Observe(time.Since(start).Seconds()) }()
+
+	db, err := sql.Open("sqlite3", config.DatabasePath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	entries, err := os.ReadDir(config.QueriesPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		logger.Debug("running query", "query", name, "account", account)
+
+		query, err := os.ReadFile(filepath.Join(config.QueriesPath, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		if err := runQuery(db, registry, name, string(query), account); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// registerGaugeVec registers gauge, reusing the already-registered
+// collector of the same name if one exists. This lets Compute be called
+// once per account against a shared registry without panicking on the
+// second account's duplicate metric name.
+func registerGaugeVec(registry *prometheus.Registry, gauge *prometheus.GaugeVec) (*prometheus.GaugeVec, error) {
+	if err := registry.Register(gauge); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		existing, ok := are.ExistingCollector.(*prometheus.GaugeVec)
+		if !ok {
+			return nil, err
+		}
+		return existing, nil
+	}
+	return gauge, nil
+}
+
+func runQuery(db *sql.DB, registry *prometheus.Registry, name, query, account string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	labelNames := columns[:len(columns)-1]
+	if account != "" {
+		labelNames = append(append([]string{}, labelNames...), "account")
+	}
+
+	gauge, err := registerGaugeVec(registry, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aws_cost_exporter_" + name,
+	}, labelNames))
+	if err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+
+		labels := make([]string, 0, len(labelNames))
+		for i := range columns[:len(columns)-1] {
+			labels = append(labels, toString(values[i]))
+		}
+		if account != "" {
+			labels = append(labels, account)
+		}
+
+		gauge.WithLabelValues(labels...).Set(toFloat(values[len(values)-1]))
+	}
+
+	return rows.Err()
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case string:
+		return t
+	default:
+		return ""
+	}
+}
+
+func toFloat(v interface{}) float64 {
+	switch t := v.(type) {
+	case float64:
+		return t
+	case int64:
+		return float64(t)
+	default:
+		return 0
+	}
+}
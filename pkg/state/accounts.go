@@ -0,0 +1,64 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Account describes a single payer account to fan out to in multi-account
+// mode, as listed in the --accounts-config YAML file.
+type Account struct {
+	Name       string `yaml:"name"`
+	RoleArn    string `yaml:"role_arn"`
+	ExternalID string `yaml:"external_id"`
+	Bucket     string `yaml:"bucket"`
+	Report     string `yaml:"report"`
+}
+
+// LoadAccounts reads the --accounts-config YAML file, a top-level list of
+// Account entries.
+func LoadAccounts(path string) ([]Account, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []Account
+	if err := yaml.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("parsing accounts config %s: %w", path, err)
+	}
+
+	for _, account := range accounts {
+		if account.Name == "" {
+			return nil, fmt.Errorf("accounts config %s: account missing name", path)
+		}
+		if account.RoleArn == "" {
+			return nil, fmt.Errorf("accounts config %s: account %q missing role_arn", path, account.Name)
+		}
+	}
+
+	return accounts, nil
+}
+
+// Config derives a per-account Config from the base (shared) Config,
+// pointing the fetcher at this account's bucket/report via its assumed
+// role, and namespacing its sqlite database so accounts never share rows.
+func (a Account) Config(base *Config) *Config {
+	config := *base
+
+	config.BucketName = a.Bucket
+	config.ReportName = a.Report
+	config.ChainedRole = a.RoleArn
+	config.ExternalID = a.ExternalID
+	config.Accounts = nil
+
+	ext := filepath.Ext(base.DatabasePath)
+	dir, file := filepath.Split(strings.TrimSuffix(base.DatabasePath, ext))
+	config.DatabasePath = filepath.Join(dir, file+"-"+a.Name+ext)
+
+	return &config
+}
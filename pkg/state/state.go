@@ -0,0 +1,164 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the static configuration the exporter was started with:
+// CLI flags and environment-derived settings that do not change at runtime.
+type Config struct {
+	RepositoryPath string
+	DatabasePath   string
+	QueriesPath    string
+	StateFilePath  string
+
+	BucketName  string
+	ReportName  string
+	ChainedRole string
+	// ExternalID is the STS external ID sent alongside ChainedRole when
+	// assuming it, if the role requires one.
+	ExternalID string
+
+	// Accounts, if non-empty, puts the exporter in multi-account mode:
+	// BucketName/ReportName/ChainedRole/ExternalID above are ignored in favor
+	// of a derived Config per Account (see Account.Config), whose DatabasePath
+	// is this DatabasePath suffixed with the account's name.
+	Accounts []Account
+
+	// IngestBatchSize is the number of CUR rows committed per sqlite
+	// transaction during ingestion. Zero means use the fetcher's default.
+	IngestBatchSize int
+
+	// FetchConcurrency bounds how many of one account's billing periods, and
+	// how many report parts within one billing period, are downloaded and
+	// ingested at once. Accounts are refreshed one after another. Zero or
+	// less means use the fetcher's default.
+	FetchConcurrency int
+
+	// S3Endpoint, if set, points the S3 client at an S3-compatible store
+	// (MinIO, Ceph RGW, Cloudflare R2, ...) instead of real AWS S3.
+	S3Endpoint       string
+	S3Region         string
+	S3ForcePathStyle bool
+	S3Insecure       bool
+	S3AccessKey      string
+	S3SecretKey      string
+}
+
+// State holds the exporter's runtime state that is persisted to disk between
+// restarts so we don't refetch reports we already have.
+type State struct {
+	Periods            []BillingPeriod      `json:"-"`
+	ReportLastModified map[string]time.Time `json:"reportLastModified"`
+
+	// mu guards ReportLastModified against Prefetch's bounded worker pool
+	// updating several periods' entries concurrently.
+	mu sync.Mutex
+}
+
+// LastModified returns the cached last-modified time for key and whether it
+// was present.
+func (s *State) LastModified(key string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.ReportLastModified[key]
+	return t, ok
+}
+
+// SetLastModified records key's last-modified time.
+func (s *State) SetLastModified(key string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ReportLastModified[key] = t
+}
+
+// ReportKey returns the key under which State.ReportLastModified tracks a
+// billing period's last-modified timestamp. Namespacing by account keeps
+// multiple payers' reports from clobbering each other's cache entry; account
+// is empty in single-account mode.
+func ReportKey(account string, period BillingPeriod) string {
+	if account == "" {
+		return string(period)
+	}
+	return account + "/" + string(period)
+}
+
+// BillingPeriod identifies a CUR billing period in AWS's "YYYYMMDD-YYYYMMDD"
+// format, e.g. "20230101-20230201".
+type BillingPeriod string
+
+// ParseBillingPeriod validates that s looks like an AWS CUR billing period
+// prefix and returns it as a BillingPeriod.
+func ParseBillingPeriod(s string) (*BillingPeriod, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid billing period: %s", s)
+	}
+
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			return nil, fmt.Errorf("invalid billing period: %s", s)
+		}
+	}
+
+	period := BillingPeriod(s)
+	return &period, nil
+}
+
+// IsPastDue reports whether this billing period has ended and therefore its
+// report is unlikely to receive further updates from AWS.
+func (p BillingPeriod) IsPastDue() bool {
+	parts := strings.Split(string(p), "-")
+	if len(parts) != 2 {
+		return false
+	}
+
+	end, err := time.Parse("20060102", parts[1])
+	if err != nil {
+		return false
+	}
+
+	return time.Now().After(end)
+}
+
+// Load reads the persisted exporter state from config.StateFilePath. A
+// missing file is not an error; a fresh State is returned instead.
+func Load(config *Config) (*State, error) {
+	state := &State{
+		ReportLastModified: make(map[string]time.Time),
+	}
+
+	data, err := os.ReadFile(config.StateFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	if state.ReportLastModified == nil {
+		state.ReportLastModified = make(map[string]time.Time)
+	}
+
+	return state, nil
+}
+
+// Save persists state to config.StateFilePath.
+func (s *State) Save(config *Config) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(config.StateFilePath, data, 0644)
+}